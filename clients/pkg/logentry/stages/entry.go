@@ -0,0 +1,17 @@
+package stages
+
+import (
+	"time"
+
+	"github.com/prometheus/common/model"
+)
+
+// Entry is the unit of data passed through a pipeline. Each stage may read
+// from and mutate Extracted, Labels, Line and Timestamp before handing the
+// Entry off to the next stage.
+type Entry struct {
+	Extracted map[string]interface{}
+	Labels    model.LabelSet
+	Line      string
+	Timestamp time.Time
+}
@@ -0,0 +1,62 @@
+package stages
+
+import (
+	"time"
+
+	"github.com/prometheus/common/model"
+	"gopkg.in/yaml.v2"
+)
+
+type testPipelineConfig struct {
+	PipelineStages PipelineStages `yaml:"pipeline_stages"`
+}
+
+// loadConfig unmarshals a `pipeline_stages:` YAML document into the slice
+// of raw stage configs NewPipeline expects, panicking on invalid YAML since
+// it's only ever fed fixtures defined in this package's tests.
+func loadConfig(yml string) PipelineStages {
+	var config testPipelineConfig
+	if err := yaml.Unmarshal([]byte(yml), &config); err != nil {
+		panic(err)
+	}
+	return config.PipelineStages
+}
+
+// newEntry builds an Entry for tests, defaulting Extracted to an empty map
+// so stages can write into it without a nil check.
+func newEntry(extracted map[string]interface{}, lbs model.LabelSet, line string, ts time.Time) Entry {
+	if extracted == nil {
+		extracted = map[string]interface{}{}
+	}
+	return Entry{
+		Extracted: extracted,
+		Labels:    lbs,
+		Line:      line,
+		Timestamp: ts,
+	}
+}
+
+// toLabelSet converts a plain map into a model.LabelSet.
+func toLabelSet(labels map[string]string) model.LabelSet {
+	lbs := make(model.LabelSet, len(labels))
+	for k, v := range labels {
+		lbs[model.LabelName(k)] = model.LabelValue(v)
+	}
+	return lbs
+}
+
+// processEntries pushes entries through a StageProcessor (or Pipeline) and collects
+// whatever comes out the other side.
+func processEntries(s StageProcessor, entries ...Entry) []Entry {
+	in := make(chan Entry, len(entries))
+	for _, e := range entries {
+		in <- e
+	}
+	close(in)
+
+	var out []Entry
+	for e := range s.Run(in) {
+		out = append(out, e)
+	}
+	return out
+}
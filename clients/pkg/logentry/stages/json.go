@@ -0,0 +1,486 @@
+package stages
+
+import (
+	"encoding/json"
+	"reflect"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/jmespath/go-jmespath"
+	"github.com/mitchellh/mapstructure"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Configuration errors.
+const (
+	ErrExpressionsRequired       = "expressions is required"
+	ErrCouldNotCompileJMES       = "could not compile JMES expression"
+	ErrEmptyJSONStageSource      = "empty source"
+	ErrInvalidJSONExpressionType = "invalid expression type"
+	ErrInvalidJSONOnError        = "invalid on_error value"
+)
+
+// JSONExpressionType selects how a JMESPath expression's result is
+// represented in Extracted.
+type JSONExpressionType string
+
+const (
+	// JSONExpressionTypeJSONString re-marshals non-scalar results (arrays,
+	// objects) back into their JSON string representation. This is the
+	// default, kept for backwards compatibility with pipelines that feed
+	// the result into a further stage expecting a string (e.g. a second
+	// json stage with source: set to this field).
+	JSONExpressionTypeJSONString JSONExpressionType = "json_string"
+	// JSONExpressionTypeSlice keeps the result as a native []interface{},
+	// skipping the marshal round trip.
+	JSONExpressionTypeSlice JSONExpressionType = "slice"
+	// JSONExpressionTypeObject keeps the result as a native
+	// map[string]interface{}, skipping the marshal round trip.
+	JSONExpressionTypeObject JSONExpressionType = "object"
+	// The following types coerce a scalar JMESPath result (typically a
+	// string or float64, JSON has no other primitives) into a more useful
+	// Go type for downstream stages - e.g. metrics stages expecting
+	// numbers, or labels stages expecting strings.
+	JSONExpressionTypeInt       JSONExpressionType = "int"
+	JSONExpressionTypeFloat     JSONExpressionType = "float"
+	JSONExpressionTypeBool      JSONExpressionType = "bool"
+	JSONExpressionTypeString    JSONExpressionType = "string"
+	JSONExpressionTypeDuration  JSONExpressionType = "duration"
+	JSONExpressionTypeTimestamp JSONExpressionType = "timestamp"
+)
+
+// validJSONExpressionTypes enumerates every type accepted by
+// JSONExpressionConfig.Type, including the empty default.
+var validJSONExpressionTypes = map[JSONExpressionType]bool{
+	"":                           true,
+	JSONExpressionTypeJSONString: true,
+	JSONExpressionTypeSlice:      true,
+	JSONExpressionTypeObject:     true,
+	JSONExpressionTypeInt:        true,
+	JSONExpressionTypeFloat:      true,
+	JSONExpressionTypeBool:       true,
+	JSONExpressionTypeString:     true,
+	JSONExpressionTypeDuration:   true,
+	JSONExpressionTypeTimestamp:  true,
+}
+
+// JSONOnErrorPolicy selects what a JSONExpressionConfig does when its Type
+// coercion fails.
+type JSONOnErrorPolicy string
+
+const (
+	// JSONOnErrorKeepRaw keeps the uncoerced JMES result as-is; unlike an
+	// empty Type, a non-scalar result is not marshalled to a JSON string.
+	// This is the default.
+	JSONOnErrorKeepRaw JSONOnErrorPolicy = "keep_raw"
+	// JSONOnErrorSkip leaves the extracted field unset.
+	JSONOnErrorSkip JSONOnErrorPolicy = "skip"
+	// JSONOnErrorDrop drops the entry entirely, like DropMalformed.
+	JSONOnErrorDrop JSONOnErrorPolicy = "drop"
+)
+
+var validJSONOnErrorPolicies = map[JSONOnErrorPolicy]bool{
+	"":                 true,
+	JSONOnErrorKeepRaw: true,
+	JSONOnErrorSkip:    true,
+	JSONOnErrorDrop:    true,
+}
+
+// JSONExpressionConfig is a single entry of JSONConfig.Expressions. It may
+// be written in YAML either as a plain JMESPath string - shorthand for
+// {expr: <string>} - or as an object selecting how the JMESPath result
+// should be represented in Extracted.
+type JSONExpressionConfig struct {
+	Expression string             `mapstructure:"expr"`
+	Type       JSONExpressionType `mapstructure:"type"`
+	// Format is used by the "timestamp" type as the reference layout
+	// (Go's time.Parse syntax) to parse the value with. Defaults to
+	// time.RFC3339Nano.
+	Format string `mapstructure:"format"`
+	// OnError selects what happens when Type coercion fails. Defaults to
+	// JSONOnErrorKeepRaw.
+	OnError JSONOnErrorPolicy `mapstructure:"on_error"`
+}
+
+// JSONConfig configures a JSON stage, which parses a JSON document out of
+// either the log line or a previously extracted field and pulls values out
+// of it using JMESPath expressions.
+type JSONConfig struct {
+	// Expressions maps an extracted key name to the JMESPath expression
+	// used to populate it. An empty expression defaults to the key name
+	// itself, so `app:` is shorthand for `app: app`.
+	Expressions map[string]JSONExpressionConfig `mapstructure:"expressions"`
+	// Source holds the name of the extracted field to parse as JSON. When
+	// nil, the raw log line is parsed instead.
+	Source *string `mapstructure:"source"`
+	// DropMalformed, when true, drops entries whose JSON document (as
+	// selected by Source, or the log line) fails to parse.
+	DropMalformed bool `mapstructure:"drop_malformed"`
+}
+
+var jsonExpressionConfigType = reflect.TypeOf(JSONExpressionConfig{})
+
+// decodeJSONExpressionHook lets an expressions entry be written as a plain
+// JMESPath string in YAML, the legacy shorthand for {expr: <string>}.
+func decodeJSONExpressionHook(from, to reflect.Type, data interface{}) (interface{}, error) {
+	if to != jsonExpressionConfigType || from.Kind() != reflect.String {
+		return data, nil
+	}
+	return JSONExpressionConfig{Expression: data.(string)}, nil
+}
+
+// parseJSONConfig decodes a raw stage config into a JSONConfig.
+func parseJSONConfig(config interface{}) (*JSONConfig, error) {
+	cfg := &JSONConfig{}
+	if config == nil {
+		return cfg, nil
+	}
+	decoder, err := mapstructure.NewDecoder(&mapstructure.DecoderConfig{
+		DecodeHook: decodeJSONExpressionHook,
+		Result:     cfg,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err := decoder.Decode(config); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// jsonExpression is a compiled, validated JSONExpressionConfig entry.
+type jsonExpression struct {
+	path    *jmespath.JMESPath
+	typ     JSONExpressionType
+	format  string
+	onError JSONOnErrorPolicy
+}
+
+// validateJSONConfig compiles the configured expressions and validates the
+// rest of the config, returning the compiled expressions keyed by their
+// extracted field name.
+func validateJSONConfig(c *JSONConfig) (map[string]*jsonExpression, error) {
+	if c == nil || len(c.Expressions) == 0 {
+		return nil, errors.New(ErrExpressionsRequired)
+	}
+
+	expressions := map[string]*jsonExpression{}
+	for name, exp := range c.Expressions {
+		if !validJSONExpressionTypes[exp.Type] {
+			return nil, errors.Errorf("%s: %s", ErrInvalidJSONExpressionType, exp.Type)
+		}
+		if !validJSONOnErrorPolicies[exp.OnError] {
+			return nil, errors.Errorf("%s: %s", ErrInvalidJSONOnError, exp.OnError)
+		}
+
+		path := exp.Expression
+		if path == "" {
+			path = name
+		}
+		jmesPath, err := jmespath.Compile(path)
+		if err != nil {
+			return nil, errors.Wrap(err, ErrCouldNotCompileJMES)
+		}
+
+		onError := exp.OnError
+		if onError == "" {
+			onError = JSONOnErrorKeepRaw
+		}
+
+		expressions[name] = &jsonExpression{path: jmesPath, typ: exp.Type, format: exp.Format, onError: onError}
+	}
+
+	if c.Source != nil && *c.Source == "" {
+		return nil, errors.New(ErrEmptyJSONStageSource)
+	}
+
+	return expressions, nil
+}
+
+// processJSONExpression evaluates a single compiled expression against data
+// and stores the result under name in extracted. It returns false when the
+// whole entry should be dropped (expr.onError is JSONOnErrorDrop and
+// coercion failed).
+//
+// With expr.typ set to "slice" or "object" the native JMESPath result
+// ([]interface{} or map[string]interface{}) is kept as-is. With expr.typ
+// set to one of the scalar coercion types (int, float, bool, string,
+// duration, timestamp), the result is converted to that Go type, falling
+// back to expr.onError on failure. Otherwise (the default, "json_string")
+// scalar results are kept as-is and anything else is marshalled back to its
+// JSON string representation, so downstream stages keep working with plain
+// strings unless they opt into a typed form.
+func processJSONExpression(logger log.Logger, extracted map[string]interface{}, name string, expr *jsonExpression, data interface{}) bool {
+	value, err := expr.path.Search(data)
+	if err != nil {
+		level.Debug(logger).Log("msg", "failed to search JMES expression", "expression", name, "err", err)
+		return true
+	}
+
+	switch expr.typ {
+	case JSONExpressionTypeSlice, JSONExpressionTypeObject:
+		extracted[name] = value
+		return true
+
+	case JSONExpressionTypeInt, JSONExpressionTypeFloat, JSONExpressionTypeBool,
+		JSONExpressionTypeString, JSONExpressionTypeDuration, JSONExpressionTypeTimestamp:
+		coerced, err := coerceJSONValue(value, expr.typ, expr.format)
+		if err != nil {
+			level.Debug(logger).Log("msg", "failed to coerce JMES expression result", "expression", name, "type", expr.typ, "err", err)
+			switch expr.onError {
+			case JSONOnErrorDrop:
+				return false
+			case JSONOnErrorKeepRaw:
+				extracted[name] = value
+			}
+			return true
+		}
+		extracted[name] = coerced
+		return true
+	}
+
+	switch value.(type) {
+	case float64, string, bool, nil:
+		extracted[name] = value
+	default:
+		buf, err := json.Marshal(value)
+		if err != nil {
+			level.Debug(logger).Log("msg", "failed to marshal JMES expression result", "expression", name, "err", err)
+			return true
+		}
+		extracted[name] = string(buf)
+	}
+	return true
+}
+
+// coerceJSONValue converts a decoded-JSON scalar (string, float64, bool, or
+// nil) to the Go type selected by typ. format is only used by the
+// "timestamp" type.
+func coerceJSONValue(value interface{}, typ JSONExpressionType, format string) (interface{}, error) {
+	switch typ {
+	case JSONExpressionTypeInt:
+		switch v := value.(type) {
+		case float64:
+			return int64(v), nil
+		case string:
+			return strconv.ParseInt(v, 10, 64)
+		default:
+			return nil, errors.Errorf("cannot coerce %T to int", value)
+		}
+
+	case JSONExpressionTypeFloat:
+		switch v := value.(type) {
+		case float64:
+			return v, nil
+		case string:
+			return strconv.ParseFloat(v, 64)
+		default:
+			return nil, errors.Errorf("cannot coerce %T to float", value)
+		}
+
+	case JSONExpressionTypeBool:
+		switch v := value.(type) {
+		case bool:
+			return v, nil
+		case string:
+			return strconv.ParseBool(v)
+		default:
+			return nil, errors.Errorf("cannot coerce %T to bool", value)
+		}
+
+	case JSONExpressionTypeString:
+		switch v := value.(type) {
+		case string:
+			return v, nil
+		case float64:
+			return strconv.FormatFloat(v, 'f', -1, 64), nil
+		case bool:
+			return strconv.FormatBool(v), nil
+		case nil:
+			return "", nil
+		default:
+			buf, err := json.Marshal(v)
+			if err != nil {
+				return nil, err
+			}
+			return string(buf), nil
+		}
+
+	case JSONExpressionTypeDuration:
+		s, ok := value.(string)
+		if !ok {
+			return nil, errors.Errorf("cannot coerce %T to duration", value)
+		}
+		return time.ParseDuration(s)
+
+	case JSONExpressionTypeTimestamp:
+		s, ok := value.(string)
+		if !ok {
+			return nil, errors.Errorf("cannot coerce %T to timestamp", value)
+		}
+		layout := format
+		if layout == "" {
+			layout = time.RFC3339Nano
+		}
+		return time.Parse(layout, s)
+
+	default:
+		return value, nil
+	}
+}
+
+// jsonDroppedLines counts entries a json stage dropped (malformed JSON, or
+// an expression whose coercion failed with on_error: drop). It's registered
+// once per stage instance via mustRegisterOrGet, so rebuilding a pipeline
+// against the same registerer - e.g. on a config reload that changes the
+// stage's type - doesn't panic on a duplicate registration.
+var jsonDroppedLines = prometheus.NewCounter(prometheus.CounterOpts{
+	Name: "logentry_json_stage_dropped_lines_total",
+	Help: "Total number of entries dropped by a json pipeline stage.",
+})
+
+type jsonStage struct {
+	mu          sync.RWMutex
+	cfg         JSONConfig
+	expressions map[string]*jsonExpression
+	logger      log.Logger
+	dropped     prometheus.Counter
+}
+
+// newJSONStage creates a new json stage. config may be either a raw stage
+// config (as parsed from YAML) or an already-built JSONConfig, so tests can
+// construct stages directly without going through parseJSONConfig.
+func newJSONStage(logger log.Logger, config interface{}, registerer prometheus.Registerer) (StageProcessor, error) {
+	cfg, ok := config.(JSONConfig)
+	if !ok {
+		c, err := parseJSONConfig(config)
+		if err != nil {
+			return nil, err
+		}
+		cfg = *c
+	}
+
+	expressions, err := validateJSONConfig(&cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	dropped := mustRegisterOrGet(registerer, jsonDroppedLines).(prometheus.Counter)
+
+	return &jsonStage{
+		cfg:         cfg,
+		expressions: expressions,
+		logger:      log.With(logger, "component", "stage", "type", StageTypeJSON),
+		dropped:     dropped,
+	}, nil
+}
+
+func (j *jsonStage) Name() string {
+	return StageTypeJSON
+}
+
+func (j *jsonStage) Run(in <-chan Entry) <-chan Entry {
+	out := make(chan Entry)
+	go func() {
+		defer close(out)
+		for e := range in {
+			if j.processEntry(&e) {
+				out <- e
+			}
+		}
+	}()
+	return out
+}
+
+// UpdateConfig re-parses and validates cfg, swapping it in under lock so a
+// config reload doesn't race with processEntry running against inflight
+// entries in Run's goroutine.
+func (j *jsonStage) UpdateConfig(config interface{}) error {
+	cfg, ok := config.(JSONConfig)
+	if !ok {
+		c, err := parseJSONConfig(config)
+		if err != nil {
+			return err
+		}
+		cfg = *c
+	}
+
+	expressions, err := validateJSONConfig(&cfg)
+	if err != nil {
+		return err
+	}
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.cfg = cfg
+	j.expressions = expressions
+	return nil
+}
+
+// Cleanup implements StageProcessor. jsonDroppedLines is a shared package
+// level metric so other json stages can keep counting against it; there's
+// nothing for an individual stage instance to release.
+func (j *jsonStage) Cleanup() {}
+
+// processEntry parses the configured JSON document and applies every
+// expression to it. It returns false when the entry should be dropped.
+func (j *jsonStage) processEntry(e *Entry) bool {
+	j.mu.RLock()
+	cfg, expressions := j.cfg, j.expressions
+	j.mu.RUnlock()
+
+	var data interface{}
+
+	if cfg.Source != nil {
+		raw, ok := e.Extracted[*cfg.Source]
+		if !ok {
+			return true
+		}
+		switch v := raw.(type) {
+		case map[string]interface{}, []interface{}:
+			// An earlier json stage kept this as a native value (type:
+			// object/slice) - consume it directly instead of round
+			// tripping it through json.Marshal/Unmarshal.
+			data = v
+		case string:
+			if v == "" {
+				return true
+			}
+			var parsed map[string]interface{}
+			if err := json.Unmarshal([]byte(v), &parsed); err != nil {
+				level.Debug(j.logger).Log("msg", "failed to unmarshal json", "err", err)
+				if cfg.DropMalformed {
+					j.dropped.Inc()
+					return false
+				}
+				return true
+			}
+			data = parsed
+		default:
+			return true
+		}
+	} else {
+		var parsed map[string]interface{}
+		if err := json.Unmarshal([]byte(e.Line), &parsed); err != nil {
+			level.Debug(j.logger).Log("msg", "failed to unmarshal json", "err", err)
+			if cfg.DropMalformed {
+				j.dropped.Inc()
+				return false
+			}
+			return true
+		}
+		data = parsed
+	}
+
+	for name, expr := range expressions {
+		if !processJSONExpression(j.logger, e.Extracted, name, expr, data) {
+			j.dropped.Inc()
+			return false
+		}
+	}
+	return true
+}
@@ -107,9 +107,9 @@ func TestYamlMapStructure(t *testing.T) {
 	got, err := parseJSONConfig(p)
 	assert.NoError(t, err, "could not create parser from yaml: %s", err)
 	want := &JSONConfig{
-		Expressions: map[string]string{
-			"key1": "expression1",
-			"key2": "expression2.expression2",
+		Expressions: map[string]JSONExpressionConfig{
+			"key1": {Expression: "expression1"},
+			"key2": {Expression: "expression2.expression2"},
 		},
 	}
 	assert.True(t, reflect.DeepEqual(got, want), "want: %+v got: %+v", want, got)
@@ -203,6 +203,8 @@ var logFixture = `
 		"integer": 123,
 		"string": "123"
 	},
+	"flag": true,
+	"duration": "250ms",
 	"nested" : {"child":"value"},
 	"message" : "this is a log line",
 	"complex" : {
@@ -351,9 +353,9 @@ func TestValidateJSONDrop(t *testing.T) {
 	labels := map[string]string{"foo": "bar"}
 	matchConfig := JSONConfig{
 		DropMalformed: true,
-		Expressions:   map[string]string{"page": "page"},
+		Expressions:   map[string]JSONExpressionConfig{"page": {Expression: "page"}},
 	}
-	s, err := newJSONStage(util_log.Logger, matchConfig)
+	s, err := newJSONStage(util_log.Logger, matchConfig, nil)
 	assert.NoError(t, err, "withMatcher() error = %v", err)
 	assert.NotNil(t, s, "newJSONStage failed to create the pipeline stage and was nil")
 	out := processEntries(s, newEntry(map[string]interface{}{
@@ -366,3 +368,139 @@ func TestValidateJSONDrop(t *testing.T) {
 	}, toLabelSet(labels), `{"page": 1, fruits": ["apple", "peach"]}`, time.Now()))
 	assert.Equal(t, 0, len(out), "stage should have kept zero valid json line but got %v", out)
 }
+
+func TestJSONParser_TypedExpressions(t *testing.T) {
+	t.Parallel()
+
+	p, err := New(util_log.Logger, nil, StageTypeJSON, JSONConfig{
+		Expressions: map[string]JSONExpressionConfig{
+			"nested_string": {Expression: "nested", Type: JSONExpressionTypeJSONString},
+			"nested_object": {Expression: "nested", Type: JSONExpressionTypeObject},
+			"component":     {Expression: "component", Type: JSONExpressionTypeSlice},
+		},
+	}, nil)
+	assert.NoError(t, err, "failed to create json parser: %s", err)
+
+	out := processEntries(p, newEntry(nil, nil, testJSONLogLine, time.Now()))[0]
+
+	assert.Equal(t, "{\"child\":\"value\"}", out.Extracted["nested_string"])
+	assert.Equal(t, map[string]interface{}{"child": "value"}, out.Extracted["nested_object"])
+	assert.Equal(t, []interface{}{"parser", "type"}, out.Extracted["component"])
+}
+
+var testJSONYamlMultiStageWithTypedSource = `
+pipeline_stages:
+- json:
+    expressions:
+      nested:
+        expr: nested
+        type: object
+- json:
+    expressions:
+      child:
+    source: nested
+`
+
+// TestJSONParser_TypedSourceSkipsMarshalRoundTrip proves that a type:
+// object/slice expression's native value can feed a downstream json
+// stage's source: directly - the whole point of keeping it native instead
+// of the default json_string - without it being re-marshalled to a string
+// first.
+func TestJSONParser_TypedSourceSkipsMarshalRoundTrip(t *testing.T) {
+	t.Parallel()
+
+	pl, err := NewPipeline(util_log.Logger, loadConfig(testJSONYamlMultiStageWithTypedSource), nil, nil)
+	assert.NoError(t, err, "Expected pipeline creation to not result in error")
+
+	out := processEntries(pl, newEntry(nil, nil, testJSONLogLine, time.Now()))[0]
+
+	assert.Equal(t, map[string]interface{}{
+		"nested": map[string]interface{}{"child": "value"},
+		"child":  "value",
+	}, out.Extracted)
+}
+
+func TestJSONParser_TypeCoercion(t *testing.T) {
+	t.Parallel()
+
+	p, err := New(util_log.Logger, nil, StageTypeJSON, JSONConfig{
+		Expressions: map[string]JSONExpressionConfig{
+			"as_int":    {Expression: "numeric.string", Type: JSONExpressionTypeInt},
+			"as_float":  {Expression: "numeric.integer", Type: JSONExpressionTypeFloat},
+			"as_string": {Expression: "numeric.float", Type: JSONExpressionTypeString},
+			"as_bool":   {Expression: "flag", Type: JSONExpressionTypeBool},
+			"as_dur":    {Expression: "duration", Type: JSONExpressionTypeDuration},
+			"as_ts":     {Expression: "time", Type: JSONExpressionTypeTimestamp},
+		},
+	}, nil)
+	assert.NoError(t, err, "failed to create json parser: %s", err)
+
+	out := processEntries(p, newEntry(nil, nil, logFixture, time.Now()))[0]
+
+	assert.Equal(t, int64(123), out.Extracted["as_int"])
+	assert.Equal(t, float64(123), out.Extracted["as_float"])
+	assert.Equal(t, "12.34", out.Extracted["as_string"])
+	assert.Equal(t, true, out.Extracted["as_bool"])
+	assert.Equal(t, 250*time.Millisecond, out.Extracted["as_dur"])
+
+	ts, ok := out.Extracted["as_ts"].(time.Time)
+	assert.True(t, ok, "expected as_ts to be a time.Time, got %T", out.Extracted["as_ts"])
+	assert.Equal(t, 2012, ts.Year())
+}
+
+func TestJSONParser_TypeCoercionOnError(t *testing.T) {
+	t.Parallel()
+
+	tests := map[string]struct {
+		expr     JSONExpressionConfig
+		expected map[string]interface{}
+		dropped  bool
+	}{
+		"keep_raw is the default": {
+			JSONExpressionConfig{Expression: "message", Type: JSONExpressionTypeInt},
+			map[string]interface{}{"out": "this is a log line"},
+			false,
+		},
+		"skip leaves the field unset": {
+			JSONExpressionConfig{Expression: "message", Type: JSONExpressionTypeInt, OnError: JSONOnErrorSkip},
+			map[string]interface{}{},
+			false,
+		},
+		"drop discards the whole entry": {
+			JSONExpressionConfig{Expression: "message", Type: JSONExpressionTypeInt, OnError: JSONOnErrorDrop},
+			nil,
+			true,
+		},
+	}
+
+	for tName, tt := range tests {
+		t.Run(tName, func(t *testing.T) {
+			t.Parallel()
+			p, err := New(util_log.Logger, nil, StageTypeJSON, JSONConfig{
+				Expressions: map[string]JSONExpressionConfig{"out": tt.expr},
+			}, nil)
+			assert.NoError(t, err, "failed to create json parser: %s", err)
+
+			out := processEntries(p, newEntry(nil, nil, logFixture, time.Now()))
+			if tt.dropped {
+				assert.Equal(t, 0, len(out))
+				return
+			}
+			assert.Equal(t, tt.expected, out[0].Extracted)
+		})
+	}
+}
+
+func TestJSONConfig_validateRejectsUnknownTypes(t *testing.T) {
+	t.Parallel()
+
+	c, err := parseJSONConfig(map[string]interface{}{
+		"expressions": map[string]interface{}{
+			"extr1": map[string]interface{}{"expr": "extr1", "type": "not-a-real-type"},
+		},
+	})
+	assert.NoError(t, err, "failed to create config: %s", err)
+
+	_, err = validateJSONConfig(c)
+	assert.Error(t, err)
+}
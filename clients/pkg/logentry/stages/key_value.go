@@ -0,0 +1,281 @@
+package stages
+
+import (
+	"strings"
+	"sync"
+	"unicode"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/mitchellh/mapstructure"
+	"github.com/pkg/errors"
+)
+
+// Configuration errors.
+const (
+	ErrEmptyKeyValueStageSource = "empty source"
+
+	defaultKeyValueDelimiter = "="
+)
+
+// KeyValueConfig configures a key_value stage, which parses logfmt-like
+// `key=value key2="value 2"` lines (nginx access logs, systemd, HAProxy,
+// syslog KV extensions, ...) into extracted fields.
+type KeyValueConfig struct {
+	// Expressions mirrors the json stage's expressions: a key names the
+	// extracted field to populate and its value is the key to read from
+	// the parsed pairs, defaulting to the same name when empty. When set,
+	// it also whitelists the parsed pairs - only the keys mentioned here
+	// make it into Extracted.
+	Expressions map[string]string `mapstructure:"expressions"`
+	// Source holds the name of the extracted field to parse. When nil,
+	// the raw log line is parsed instead.
+	Source *string `mapstructure:"source"`
+	// KeyValueDelimiter separates a key from its value, defaulting to "=".
+	KeyValueDelimiter string `mapstructure:"key_value_delimiter"`
+	// PairDelimiter separates pairs from each other. Defaults to
+	// whitespace when empty.
+	PairDelimiter string `mapstructure:"pair_delimiter"`
+	// DropMalformed, when true, drops entries from which no key at all
+	// can be parsed. A token without KeyValueDelimiter still counts as a
+	// key (with an empty value), so it keeps the entry.
+	DropMalformed bool `mapstructure:"drop_malformed"`
+	// KeepEmptyValue keeps keys whose value is the empty string. By
+	// default those keys are dropped.
+	KeepEmptyValue bool `mapstructure:"keep_empty"`
+}
+
+// parseKeyValueConfig decodes a raw stage config into a KeyValueConfig.
+func parseKeyValueConfig(config interface{}) (*KeyValueConfig, error) {
+	cfg := &KeyValueConfig{}
+	if config == nil {
+		return cfg, nil
+	}
+	if err := mapstructure.Decode(config, cfg); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// validateKeyValueConfig applies defaults and validates c in place.
+func validateKeyValueConfig(c *KeyValueConfig) error {
+	if c.Source != nil && *c.Source == "" {
+		return errors.New(ErrEmptyKeyValueStageSource)
+	}
+	if c.KeyValueDelimiter == "" {
+		c.KeyValueDelimiter = defaultKeyValueDelimiter
+	}
+	return nil
+}
+
+type keyValueStage struct {
+	mu     sync.RWMutex
+	cfg    KeyValueConfig
+	logger log.Logger
+}
+
+// newKeyValueStage creates a new key_value stage. config may be either a
+// raw stage config (as parsed from YAML) or an already-built
+// KeyValueConfig, mirroring newJSONStage so tests can build stages
+// directly.
+func newKeyValueStage(logger log.Logger, config interface{}) (StageProcessor, error) {
+	cfg, ok := config.(KeyValueConfig)
+	if !ok {
+		c, err := parseKeyValueConfig(config)
+		if err != nil {
+			return nil, err
+		}
+		cfg = *c
+	}
+
+	if err := validateKeyValueConfig(&cfg); err != nil {
+		return nil, err
+	}
+
+	return &keyValueStage{
+		cfg:    cfg,
+		logger: log.With(logger, "component", "stage", "type", StageTypeKeyValue),
+	}, nil
+}
+
+func (k *keyValueStage) Name() string {
+	return StageTypeKeyValue
+}
+
+func (k *keyValueStage) Run(in <-chan Entry) <-chan Entry {
+	out := make(chan Entry)
+	go func() {
+		defer close(out)
+		for e := range in {
+			if k.processEntry(&e) {
+				out <- e
+			}
+		}
+	}()
+	return out
+}
+
+// UpdateConfig re-parses and validates cfg, swapping it in under lock so a
+// config reload doesn't race with processEntry running against inflight
+// entries in Run's goroutine.
+func (k *keyValueStage) UpdateConfig(config interface{}) error {
+	cfg, ok := config.(KeyValueConfig)
+	if !ok {
+		c, err := parseKeyValueConfig(config)
+		if err != nil {
+			return err
+		}
+		cfg = *c
+	}
+
+	if err := validateKeyValueConfig(&cfg); err != nil {
+		return err
+	}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.cfg = cfg
+	return nil
+}
+
+// Cleanup implements StageProcessor. The key_value stage owns no resources
+// that outlive it.
+func (k *keyValueStage) Cleanup() {}
+
+// processEntry parses the configured key/value document and writes the
+// (optionally renamed/whitelisted) pairs into e.Extracted. It returns false
+// when the entry should be dropped.
+func (k *keyValueStage) processEntry(e *Entry) bool {
+	k.mu.RLock()
+	cfg := k.cfg
+	k.mu.RUnlock()
+
+	input := e.Line
+
+	if cfg.Source != nil {
+		raw, ok := e.Extracted[*cfg.Source]
+		if !ok {
+			return true
+		}
+		s, ok := raw.(string)
+		if !ok || s == "" {
+			return true
+		}
+		input = s
+	}
+
+	pairs := parseKeyValuePairs(input, cfg.KeyValueDelimiter, cfg.PairDelimiter)
+	if len(pairs) == 0 {
+		level.Debug(k.logger).Log("msg", "found no key/value pairs", "line", input)
+		return !cfg.DropMalformed
+	}
+
+	// Expressions mirrors the json stage: a key names the extracted field
+	// to populate, and its (optional) value is the key to pull out of the
+	// parsed pairs, defaulting to the same name. When set, it also acts
+	// as a whitelist - keys not mentioned are dropped.
+	if len(cfg.Expressions) > 0 {
+		for name, source := range cfg.Expressions {
+			if source == "" {
+				source = name
+			}
+			value, ok := pairs[source]
+			if !ok || (value == "" && !cfg.KeepEmptyValue) {
+				continue
+			}
+			e.Extracted[name] = value
+		}
+		return true
+	}
+
+	for key, value := range pairs {
+		if value == "" && !cfg.KeepEmptyValue {
+			continue
+		}
+		e.Extracted[key] = value
+	}
+	return true
+}
+
+// parseKeyValuePairs splits s into key/value pairs separated by kvSep (e.g.
+// "="), with pairs themselves separated by pairSep. An empty pairSep splits
+// pairs on runs of whitespace instead of a literal separator. Values may be
+// double-quoted to embed the key/value or pair delimiter, with \" as an
+// escape for a literal quote. Malformed pairs (no delimiter found) are kept
+// with an empty value rather than discarded, so callers can decide whether
+// that counts as malformed input.
+func parseKeyValuePairs(s, kvSep, pairSep string) map[string]string {
+	if kvSep == "" {
+		kvSep = defaultKeyValueDelimiter
+	}
+
+	pairs := map[string]string{}
+	for _, pair := range splitUnquoted(s, pairSep, pairSep == "") {
+		if pair == "" {
+			continue
+		}
+		toks := splitUnquoted(pair, kvSep, false)
+		key := unquote(toks[0])
+		if key == "" {
+			continue
+		}
+		value := ""
+		if len(toks) > 1 {
+			value = unquote(strings.Join(toks[1:], kvSep))
+		}
+		pairs[key] = value
+	}
+	return pairs
+}
+
+// splitUnquoted splits s on sep (or on runs of whitespace when bySpace is
+// true), treating double-quoted substrings as atomic so sep (or whitespace)
+// inside them isn't mistaken for a delimiter. Quotes and \" escapes are left
+// verbatim in the returned tokens - unquote resolves them once a token is
+// known to be a complete key or value, so a kv-delimiter split further down
+// the line can't reinterpret an already-unescaped quote as a real one.
+func splitUnquoted(s, sep string, bySpace bool) []string {
+	var tokens []string
+	var b strings.Builder
+	inQuotes := false
+
+	for i := 0; i < len(s); {
+		switch {
+		case inQuotes && s[i] == '\\' && i+1 < len(s) && s[i+1] == '"':
+			b.WriteByte(s[i])
+			b.WriteByte(s[i+1])
+			i += 2
+		case s[i] == '"':
+			inQuotes = !inQuotes
+			b.WriteByte(s[i])
+			i++
+		case !inQuotes && bySpace && unicode.IsSpace(rune(s[i])):
+			if b.Len() > 0 {
+				tokens = append(tokens, b.String())
+				b.Reset()
+			}
+			i++
+		case !inQuotes && !bySpace && sep != "" && strings.HasPrefix(s[i:], sep):
+			tokens = append(tokens, b.String())
+			b.Reset()
+			i += len(sep)
+		default:
+			b.WriteByte(s[i])
+			i++
+		}
+	}
+	if b.Len() > 0 || !bySpace {
+		tokens = append(tokens, b.String())
+	}
+	return tokens
+}
+
+// unquote strips a token's surrounding double quotes, if any, and resolves
+// \" escapes within it. Called once splitting is entirely done, so it's the
+// only place that turns an escaped quote into a literal one.
+func unquote(s string) string {
+	if len(s) >= 2 && s[0] == '"' && s[len(s)-1] == '"' {
+		s = s[1 : len(s)-1]
+	}
+	return strings.ReplaceAll(s, `\"`, `"`)
+}
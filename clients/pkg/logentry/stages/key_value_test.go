@@ -0,0 +1,184 @@
+package stages
+
+import (
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+
+	util_log "github.com/grafana/loki/v3/pkg/util/log"
+)
+
+var testKeyValueYamlSingleStage = `
+pipeline_stages:
+- key_value:
+    expressions:
+      app:
+      lvl: level
+`
+
+var testKeyValueLogLine = `time=2012-11-01T22:08:41+00:00 app=loki level=WARN msg="this is a log line" extra="key1=val1 key2=val2"`
+
+func TestPipeline_KeyValue(t *testing.T) {
+	t.Parallel()
+
+	pl, err := NewPipeline(util_log.Logger, loadConfig(testKeyValueYamlSingleStage), nil, prometheus.DefaultRegisterer)
+	assert.NoError(t, err, "Expected pipeline creation to not result in error")
+	out := processEntries(pl, newEntry(nil, nil, testKeyValueLogLine, time.Now()))[0]
+	assert.Equal(t, map[string]interface{}{
+		"app": "loki",
+		"lvl": "WARN",
+	}, out.Extracted)
+}
+
+func TestKeyValueConfig_validate(t *testing.T) {
+	t.Parallel()
+
+	tests := map[string]struct {
+		config interface{}
+		err    error
+	}{
+		"empty config": {
+			nil,
+			nil,
+		},
+		"empty source": {
+			map[string]interface{}{
+				"source": "",
+			},
+			errors.New(ErrEmptyKeyValueStageSource),
+		},
+		"valid with source": {
+			map[string]interface{}{
+				"source": "extra",
+			},
+			nil,
+		},
+	}
+	for tName, tt := range tests {
+		t.Run(tName, func(t *testing.T) {
+			c, err := parseKeyValueConfig(tt.config)
+			assert.NoError(t, err, "failed to create config: %s", err)
+			err = validateKeyValueConfig(c)
+			if tt.err != nil {
+				assert.EqualError(t, err, tt.err.Error())
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, defaultKeyValueDelimiter, c.KeyValueDelimiter)
+		})
+	}
+}
+
+func TestKeyValueParser_Parse(t *testing.T) {
+	t.Parallel()
+
+	tests := map[string]struct {
+		config    interface{}
+		extracted map[string]interface{}
+		entry     string
+		expected  map[string]interface{}
+	}{
+		"parses the raw entry by default": {
+			map[string]interface{}{},
+			map[string]interface{}{},
+			`foo=bar baz="qux quux" empty=`,
+			map[string]interface{}{
+				"foo": "bar",
+				"baz": "qux quux",
+			},
+		},
+		"parses extracted[source] when configured": {
+			map[string]interface{}{
+				"source": "extra",
+			},
+			map[string]interface{}{
+				"extra": "user=marco team=\"loki squad\"",
+			},
+			"{}",
+			map[string]interface{}{
+				"extra": "user=marco team=\"loki squad\"",
+				"user":  "marco",
+				"team":  "loki squad",
+			},
+		},
+		"keep_empty preserves empty values": {
+			map[string]interface{}{
+				"keep_empty": true,
+			},
+			map[string]interface{}{},
+			`foo=bar empty=`,
+			map[string]interface{}{
+				"foo":   "bar",
+				"empty": "",
+			},
+		},
+		"expressions whitelist and rename keys": {
+			map[string]interface{}{
+				"expressions": map[string]string{
+					"renamed": "foo",
+				},
+			},
+			map[string]interface{}{},
+			`foo=bar baz=qux`,
+			map[string]interface{}{
+				"renamed": "bar",
+			},
+		},
+		"custom delimiters": {
+			map[string]interface{}{
+				"key_value_delimiter": ":",
+				"pair_delimiter":      ",",
+			},
+			map[string]interface{}{},
+			`foo:bar,baz:"qux,quux"`,
+			map[string]interface{}{
+				"foo": "bar",
+				"baz": "qux,quux",
+			},
+		},
+		"escaped quote inside a value is preserved": {
+			map[string]interface{}{},
+			map[string]interface{}{},
+			`msg="say \"hi\" now"`,
+			map[string]interface{}{
+				"msg": `say "hi" now`,
+			},
+		},
+		"missing extracted[source]": {
+			map[string]interface{}{
+				"source": "extra",
+			},
+			map[string]interface{}{},
+			testKeyValueLogLine,
+			map[string]interface{}{},
+		},
+	}
+
+	for tName, tt := range tests {
+		t.Run(tName, func(t *testing.T) {
+			t.Parallel()
+			p, err := New(util_log.Logger, nil, StageTypeKeyValue, tt.config, nil)
+			assert.NoError(t, err, "failed to create key_value parser: %s", err)
+			out := processEntries(p, newEntry(tt.extracted, nil, tt.entry, time.Now()))[0]
+			assert.Equal(t, tt.expected, out.Extracted)
+		})
+	}
+}
+
+func TestValidateKeyValueDrop(t *testing.T) {
+	t.Parallel()
+
+	matchConfig := KeyValueConfig{DropMalformed: true}
+	s, err := newKeyValueStage(util_log.Logger, matchConfig)
+	assert.NoError(t, err, "newKeyValueStage() error = %v", err)
+	assert.NotNil(t, s, "newKeyValueStage failed to create the pipeline stage and was nil")
+
+	out := processEntries(s, newEntry(nil, nil, `foo=bar baz=qux`, time.Now()))
+	assert.Equal(t, 1, len(out), "stage should have kept one valid key/value line but got %v", out)
+
+	out = processEntries(s, newEntry(nil, nil, ``, time.Now()))
+	assert.Equal(t, 0, len(out), "stage should have dropped the line with no key/value pairs but got %v", out)
+}
@@ -0,0 +1,20 @@
+package stages
+
+import "github.com/prometheus/client_golang/prometheus"
+
+// mustRegisterOrGet registers c with reg, returning the already-registered
+// collector instead of panicking if an equivalent one was registered before.
+// Stages call this so that building several pipelines against the same
+// registerer (e.g. on a config reload) doesn't panic on duplicate metrics.
+func mustRegisterOrGet(reg prometheus.Registerer, c prometheus.Collector) prometheus.Collector {
+	if reg == nil {
+		return c
+	}
+	if err := reg.Register(c); err != nil {
+		if are, ok := err.(prometheus.AlreadyRegisteredError); ok {
+			return are.ExistingCollector
+		}
+		panic(err)
+	}
+	return c
+}
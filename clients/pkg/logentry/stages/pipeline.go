@@ -0,0 +1,224 @@
+package stages
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/go-kit/log"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// PipelineStages is a slice of stage configurations, each decoded from a
+// single `- <stage type>: ...` entry of a `pipeline_stages:` block.
+type PipelineStages = []interface{}
+
+// PipelineStage is the raw configuration of a single stage, keyed by its
+// stage type (e.g. "json", "key_value", "template").
+type PipelineStage = map[interface{}]interface{}
+
+// Pipeline pass down a log entry to each stage for mutation and/or label
+// extraction, and implements StageProcessor so pipelines can be nested.
+type Pipeline struct {
+	logger     log.Logger
+	mu         sync.RWMutex // guards stages, so UpdateConfig is safe to call concurrently with Run/Size/String/Cleanup.
+	stages     []StageProcessor
+	jobName    *string
+	registerer prometheus.Registerer
+}
+
+// NewPipeline creates a new Pipeline from a slice of stage configurations.
+func NewPipeline(logger log.Logger, stgs PipelineStages, jobName *string, registerer prometheus.Registerer) (*Pipeline, error) {
+	st, err := buildStages(logger, stgs, jobName, registerer)
+	if err != nil {
+		return nil, err
+	}
+	return &Pipeline{logger: logger, stages: st, jobName: jobName, registerer: registerer}, nil
+}
+
+// buildStages constructs a StageProcessor for every entry of stgs, shared by
+// NewPipeline and UpdateConfig.
+func buildStages(logger log.Logger, stgs PipelineStages, jobName *string, registerer prometheus.Registerer) ([]StageProcessor, error) {
+	names, err := stageNames(stgs)
+	if err != nil {
+		return nil, err
+	}
+
+	st := make([]StageProcessor, 0, len(names))
+	for _, entry := range names {
+		l := log.With(logger, "component", "stage", "type", entry.name)
+		newStage, err := New(l, jobName, entry.name, entry.cfg, registerer)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid %s stage config", entry.name)
+		}
+		st = append(st, newStage)
+	}
+	return st, nil
+}
+
+// Name implements StageProcessor.
+func (p *Pipeline) Name() string {
+	return "pipeline"
+}
+
+// Run implements StageProcessor, chaining every configured stage's Run in order.
+func (p *Pipeline) Run(in <-chan Entry) <-chan Entry {
+	p.mu.RLock()
+	stages := p.stages
+	p.mu.RUnlock()
+
+	var out <-chan Entry = in
+	for _, s := range stages {
+		out = s.Run(out)
+	}
+	return out
+}
+
+// UpdateConfig rebuilds the pipeline's stage list from newCfg, diffing it
+// against the current stages by position and type: a stage whose type is
+// unchanged is reconfigured in place via its own UpdateConfig, so a reload
+// doesn't tear down any stage that didn't actually change shape. The
+// validation pass below still builds a throwaway instance of every stage,
+// whose metrics go through mustRegisterOrGet and so reuse the ones already
+// registered. Stages whose type changed, or that fell off
+// the end of newCfg, are cleaned up and, if still present, replaced.
+//
+// The whole of newCfg is validated (and, for stages whose type changed,
+// built) before anything live is touched: a bad entry anywhere in newCfg
+// must leave the pipeline exactly as it was, with no stage's config swapped
+// out and no stage's Cleanup already invoked.
+func (p *Pipeline) UpdateConfig(newCfg interface{}) error {
+	stgs, ok := newCfg.(PipelineStages)
+	if !ok {
+		return errors.New("invalid pipeline config, must be a PipelineStages")
+	}
+
+	names, err := stageNames(stgs)
+	if err != nil {
+		return err
+	}
+
+	p.mu.RLock()
+	current := p.stages
+	p.mu.RUnlock()
+
+	// Validation pass: build a StageProcessor for every position against a
+	// scratch slice. This doesn't touch current or call Cleanup on
+	// anything, so a failure here leaves the live pipeline untouched.
+	// Building fresh instances (rather than only dry-validating the ones
+	// whose type is unchanged) reuses New()'s own parsing/validation, which
+	// is exactly what the in-place UpdateConfig call below will run too -
+	// if it succeeds here, it's guaranteed to succeed there.
+	built := make([]StageProcessor, len(names))
+	for idx, entry := range names {
+		l := log.With(p.logger, "component", "stage", "type", entry.name)
+		newStage, err := New(l, p.jobName, entry.name, entry.cfg, p.registerer)
+		if err != nil {
+			// Release whatever the validation pass already built before
+			// hitting this error - none of it made it into the live
+			// pipeline, so nothing else should end up holding it either.
+			for _, s := range built {
+				if s != nil {
+					s.Cleanup()
+				}
+			}
+			return errors.Wrapf(err, "invalid %s stage config", entry.name)
+		}
+		built[idx] = newStage
+	}
+
+	// Apply pass: only reached once every position above validated
+	// successfully, so from here on nothing can fail partway through.
+	newStages := make([]StageProcessor, len(names))
+	for idx, entry := range names {
+		if idx < len(current) && current[idx].Name() == entry.name {
+			if err := current[idx].UpdateConfig(entry.cfg); err != nil {
+				return errors.Wrapf(err, "failed to update %s stage config", entry.name)
+			}
+			built[idx].Cleanup()
+			newStages[idx] = current[idx]
+			continue
+		}
+
+		if idx < len(current) {
+			current[idx].Cleanup()
+		}
+		newStages[idx] = built[idx]
+	}
+
+	for idx := len(names); idx < len(current); idx++ {
+		current[idx].Cleanup()
+	}
+
+	p.mu.Lock()
+	p.stages = newStages
+	p.mu.Unlock()
+	return nil
+}
+
+// Cleanup implements StageProcessor, releasing every configured stage.
+func (p *Pipeline) Cleanup() {
+	p.mu.RLock()
+	stages := p.stages
+	p.mu.RUnlock()
+
+	for _, s := range stages {
+		s.Cleanup()
+	}
+}
+
+type stageNameConfig struct {
+	name string
+	cfg  interface{}
+}
+
+// stageNames extracts the (type, raw config) pair for every entry of stgs,
+// the same validation NewPipeline's buildStages applies before constructing
+// a stage, so UpdateConfig can diff against the current stages before
+// deciding whether to build a new one.
+func stageNames(stgs PipelineStages) ([]stageNameConfig, error) {
+	names := make([]stageNameConfig, 0, len(stgs))
+	for idx, stageConfig := range stgs {
+		if stageConfig == nil {
+			continue
+		}
+		cfgMap, ok := stageConfig.(PipelineStage)
+		if !ok {
+			return nil, errors.Errorf("invalid config for stage %d, must be a map of one stage type to its config", idx)
+		}
+		if len(cfgMap) != 1 {
+			return nil, errors.Errorf("invalid config for stage %d, must contain exactly one stage type", idx)
+		}
+		for key, cfg := range cfgMap {
+			name, ok := key.(string)
+			if !ok {
+				return nil, errors.Errorf("invalid stage type at index %d: %v", idx, key)
+			}
+			names = append(names, stageNameConfig{name: name, cfg: cfg})
+		}
+	}
+	return names, nil
+}
+
+// Size returns the number of stages in the pipeline.
+func (p *Pipeline) Size() int {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return len(p.stages)
+}
+
+var _ fmt.Stringer = (*Pipeline)(nil)
+
+// String returns a human readable description of the pipeline, useful in
+// error messages and logs.
+func (p *Pipeline) String() string {
+	p.mu.RLock()
+	stages := p.stages
+	p.mu.RUnlock()
+
+	names := make([]string, 0, len(stages))
+	for _, s := range stages {
+		names = append(names, s.Name())
+	}
+	return fmt.Sprintf("pipeline%v", names)
+}
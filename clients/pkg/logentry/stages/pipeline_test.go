@@ -0,0 +1,167 @@
+package stages
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+
+	util_log "github.com/grafana/loki/v3/pkg/util/log"
+)
+
+var testPipelineYamlSingleJSONStage = `
+pipeline_stages:
+- json:
+    expressions:
+      out: message
+`
+
+var testPipelineYamlSingleJSONStageUpdated = `
+pipeline_stages:
+- json:
+    expressions:
+      out: message
+      app:
+`
+
+var testPipelineYamlKeyValueStage = `
+pipeline_stages:
+- key_value: {}
+`
+
+var testPipelineYamlTwoStages = `
+pipeline_stages:
+- json:
+    expressions:
+      out: message
+- key_value: {}
+`
+
+// testPipelineYamlTwoStagesSecondInvalid reconfigures the first (json)
+// stage's expressions in place, but its second stage switches from
+// key_value to json with no expressions - which validateJSONConfig
+// rejects.
+var testPipelineYamlTwoStagesSecondInvalid = `
+pipeline_stages:
+- json:
+    expressions:
+      out: message
+      app:
+- json: {}
+`
+
+func TestPipeline_UpdateConfig_ReconfiguresInPlace(t *testing.T) {
+	t.Parallel()
+
+	reg := prometheus.NewRegistry()
+	pl, err := NewPipeline(util_log.Logger, loadConfig(testPipelineYamlSingleJSONStage), nil, reg)
+	assert.NoError(t, err)
+	original := pl.stages[0]
+
+	err = pl.UpdateConfig(loadConfig(testPipelineYamlSingleJSONStageUpdated))
+	assert.NoError(t, err)
+	assert.Equal(t, 1, pl.Size())
+	assert.Same(t, original, pl.stages[0], "same stage type should be reconfigured in place, not recreated")
+
+	out := processEntries(pl, newEntry(nil, nil, testJSONLogLine, time.Now()))[0]
+	assert.Equal(t, map[string]interface{}{
+		"out": "this is a log line",
+		"app": "loki",
+	}, out.Extracted)
+}
+
+func TestPipeline_UpdateConfig_RecreatesOnTypeChange(t *testing.T) {
+	t.Parallel()
+
+	reg := prometheus.NewRegistry()
+	pl, err := NewPipeline(util_log.Logger, loadConfig(testPipelineYamlSingleJSONStage), nil, reg)
+	assert.NoError(t, err)
+	original := pl.stages[0]
+	assert.Equal(t, StageTypeJSON, original.Name())
+
+	err = pl.UpdateConfig(loadConfig(testPipelineYamlKeyValueStage))
+	assert.NoError(t, err)
+	assert.Equal(t, 1, pl.Size())
+	assert.NotSame(t, original, pl.stages[0], "a stage whose type changed should be recreated")
+	assert.Equal(t, StageTypeKeyValue, pl.stages[0].Name())
+}
+
+// TestPipeline_UpdateConfig_FailureLeavesPipelineUnchanged verifies that a
+// reload failing on a later stage doesn't leave an earlier stage's config
+// already swapped in place, or any stage already replaced - the whole of
+// newCfg must validate before anything live is touched.
+func TestPipeline_UpdateConfig_FailureLeavesPipelineUnchanged(t *testing.T) {
+	t.Parallel()
+
+	reg := prometheus.NewRegistry()
+	pl, err := NewPipeline(util_log.Logger, loadConfig(testPipelineYamlTwoStages), nil, reg)
+	assert.NoError(t, err)
+	firstStage, secondStage := pl.stages[0], pl.stages[1]
+
+	err = pl.UpdateConfig(loadConfig(testPipelineYamlTwoStagesSecondInvalid))
+	assert.Error(t, err)
+
+	assert.Equal(t, 2, pl.Size())
+	assert.Same(t, firstStage, pl.stages[0], "an earlier valid stage must not be swapped when a later stage fails")
+	assert.Same(t, secondStage, pl.stages[1], "the stage whose new config was rejected must not be replaced")
+
+	out := processEntries(pl, newEntry(nil, nil, testJSONLogLine, time.Now()))[0]
+	assert.Equal(t, map[string]interface{}{
+		"out": "this is a log line",
+	}, out.Extracted, "the rejected reload must not have reconfigured the first stage's expressions")
+}
+
+// TestPipeline_UpdateConfig_NoDuplicateMetricsPanic guards against duplicate
+// metrics registration: every reload builds stages through New(), so
+// building several pipelines (or updating one repeatedly) against the same
+// registerer must not panic.
+func TestPipeline_UpdateConfig_NoDuplicateMetricsPanic(t *testing.T) {
+	t.Parallel()
+
+	reg := prometheus.NewRegistry()
+	assert.NotPanics(t, func() {
+		pl, err := NewPipeline(util_log.Logger, loadConfig(testPipelineYamlSingleJSONStage), nil, reg)
+		assert.NoError(t, err)
+		for i := 0; i < 3; i++ {
+			assert.NoError(t, pl.UpdateConfig(loadConfig(testPipelineYamlKeyValueStage)))
+			assert.NoError(t, pl.UpdateConfig(loadConfig(testPipelineYamlSingleJSONStage)))
+		}
+	})
+}
+
+// TestPipeline_UpdateConfig_InflightEntriesContinue verifies a reload
+// doesn't drop entries already in flight through Run's channels.
+func TestPipeline_UpdateConfig_InflightEntriesContinue(t *testing.T) {
+	t.Parallel()
+
+	reg := prometheus.NewRegistry()
+	pl, err := NewPipeline(util_log.Logger, loadConfig(testPipelineYamlSingleJSONStage), nil, reg)
+	assert.NoError(t, err)
+
+	in := make(chan Entry)
+	out := pl.Run(in)
+
+	done := make(chan []Entry)
+	go func() {
+		var got []Entry
+		for e := range out {
+			got = append(got, e)
+		}
+		done <- got
+	}()
+
+	const total = 50
+	go func() {
+		for i := 0; i < total; i++ {
+			in <- newEntry(nil, nil, testJSONLogLine, time.Now())
+			if i == total/2 {
+				assert.NoError(t, pl.UpdateConfig(loadConfig(testPipelineYamlSingleJSONStageUpdated)))
+			}
+		}
+		close(in)
+	}()
+
+	got := <-done
+	assert.Equal(t, total, len(got), "no inflight entries should be dropped by a reload")
+}
@@ -0,0 +1,53 @@
+package stages
+
+import (
+	"github.com/go-kit/log"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Stage types that are supported by the pipeline.
+const (
+	StageTypeJSON     = "json"
+	StageTypeKeyValue = "key_value"
+	StageTypeTemplate = "template"
+)
+
+// Errors used by the stage registry.
+var (
+	ErrUnknownStageType = errors.New("unknown stage type")
+)
+
+// StageProcessor can receive entries via a channel, mutate them, and be
+// reconfigured in place - so a config reload doesn't have to tear down and
+// rebuild every pipeline stage, just the ones whose type actually changed.
+type StageProcessor interface {
+	// Name returns the stage's type, used for logging/metrics.
+	Name() string
+	// Run processes entries read from the input channel and returns a
+	// channel with the results. Implementations should close the output
+	// channel once the input channel is closed and drained.
+	Run(in <-chan Entry) <-chan Entry
+	// UpdateConfig swaps the stage's configuration in place. cfg is the
+	// same raw (or pre-built, see e.g. newJSONStage) config New() would
+	// otherwise have been called with. Implementations must be safe to
+	// call while Run's goroutine is still processing inflight entries.
+	UpdateConfig(cfg interface{}) error
+	// Cleanup releases anything the stage owns (e.g. registered metrics)
+	// before it's discarded.
+	Cleanup()
+}
+
+// New creates a new stage for the given type and configuration.
+func New(logger log.Logger, jobName *string, stageType string, cfg interface{}, registerer prometheus.Registerer) (StageProcessor, error) {
+	switch stageType {
+	case StageTypeJSON:
+		return newJSONStage(logger, cfg, registerer)
+	case StageTypeKeyValue:
+		return newKeyValueStage(logger, cfg)
+	case StageTypeTemplate:
+		return newTemplateStage(logger, cfg)
+	default:
+		return nil, errors.Errorf("%s: %s", ErrUnknownStageType, stageType)
+	}
+}
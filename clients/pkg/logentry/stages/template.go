@@ -0,0 +1,180 @@
+package stages
+
+import (
+	"bytes"
+	"encoding/json"
+	"sync"
+	"text/template"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/mitchellh/mapstructure"
+	"github.com/pkg/errors"
+)
+
+// Configuration errors.
+const (
+	ErrEmptyTemplateStageSource   = "template stage source cannot be empty"
+	ErrEmptyTemplateStageTemplate = "template stage template cannot be empty"
+)
+
+// TemplateConfig configures a template stage, which renders a Go template
+// against the entry's current extracted fields and writes the result back
+// into Extracted[Source].
+type TemplateConfig struct {
+	// Source is the extracted field the rendered template is written to.
+	// It's created if it doesn't already exist.
+	Source string `mapstructure:"source"`
+	// Template is the Go template (text/template syntax) to render. It's
+	// executed with the entry's Extracted map as its data, so fields are
+	// available as `.fieldName`, and can use the functions documented on
+	// templateFuncMap in addition to the usual builtins.
+	Template string `mapstructure:"template"`
+}
+
+// parseTemplateConfig decodes a raw stage config into a TemplateConfig.
+func parseTemplateConfig(config interface{}) (*TemplateConfig, error) {
+	cfg := &TemplateConfig{}
+	if config == nil {
+		return cfg, nil
+	}
+	if err := mapstructure.Decode(config, cfg); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+func validateTemplateConfig(c *TemplateConfig) error {
+	if c.Source == "" {
+		return errors.New(ErrEmptyTemplateStageSource)
+	}
+	if c.Template == "" {
+		return errors.New(ErrEmptyTemplateStageTemplate)
+	}
+	return nil
+}
+
+// templateFuncMap holds the functions available to a template stage, on
+// top of text/template's builtins.
+var templateFuncMap = template.FuncMap{
+	"unmarshalJSON": unmarshalJSONFunc,
+	"parseKV":       parseKVFunc,
+}
+
+// unmarshalJSONFunc exposes encoding/json to template stages, so a single
+// template stage can pull fields out of an embedded JSON blob - e.g.
+// {{ (unmarshalJSON .extra).user }} - without chaining a second json stage
+// with source: set to that field.
+func unmarshalJSONFunc(s string) (map[string]interface{}, error) {
+	var v map[string]interface{}
+	if err := json.Unmarshal([]byte(s), &v); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+// parseKVFunc exposes the key_value stage's pair parser to template
+// stages, so a single template stage can pull fields out of an embedded
+// key=value blob - e.g. {{ (parseKV .extra "=" " ").user }} - without
+// chaining a second key_value stage. An empty pairSep splits on
+// whitespace, matching the key_value stage's own default.
+func parseKVFunc(s, sep, pairSep string) map[string]string {
+	return parseKeyValuePairs(s, sep, pairSep)
+}
+
+type templateStage struct {
+	mu     sync.RWMutex
+	cfg    TemplateConfig
+	tmpl   *template.Template
+	logger log.Logger
+}
+
+// parseAndValidateTemplate decodes and compiles a raw template stage config,
+// shared by newTemplateStage and UpdateConfig.
+func parseAndValidateTemplate(config interface{}) (TemplateConfig, *template.Template, error) {
+	cfg, ok := config.(TemplateConfig)
+	if !ok {
+		c, err := parseTemplateConfig(config)
+		if err != nil {
+			return TemplateConfig{}, nil, err
+		}
+		cfg = *c
+	}
+
+	if err := validateTemplateConfig(&cfg); err != nil {
+		return TemplateConfig{}, nil, err
+	}
+
+	tmpl, err := template.New("pipeline_template").Funcs(templateFuncMap).Parse(cfg.Template)
+	if err != nil {
+		return TemplateConfig{}, nil, errors.Wrap(err, "could not parse template")
+	}
+
+	return cfg, tmpl, nil
+}
+
+// newTemplateStage creates a new template stage. config may be either a raw
+// stage config (as parsed from YAML) or an already-built TemplateConfig, so
+// tests can construct stages directly without going through
+// parseTemplateConfig.
+func newTemplateStage(logger log.Logger, config interface{}) (StageProcessor, error) {
+	cfg, tmpl, err := parseAndValidateTemplate(config)
+	if err != nil {
+		return nil, err
+	}
+
+	return &templateStage{
+		cfg:    cfg,
+		tmpl:   tmpl,
+		logger: log.With(logger, "component", "stage", "type", StageTypeTemplate),
+	}, nil
+}
+
+func (t *templateStage) Name() string {
+	return StageTypeTemplate
+}
+
+func (t *templateStage) Run(in <-chan Entry) <-chan Entry {
+	out := make(chan Entry)
+	go func() {
+		defer close(out)
+		for e := range in {
+			t.processEntry(&e)
+			out <- e
+		}
+	}()
+	return out
+}
+
+// UpdateConfig re-parses and re-compiles cfg, swapping it in under lock so a
+// config reload doesn't race with processEntry running against inflight
+// entries in Run's goroutine.
+func (t *templateStage) UpdateConfig(config interface{}) error {
+	cfg, tmpl, err := parseAndValidateTemplate(config)
+	if err != nil {
+		return err
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.cfg = cfg
+	t.tmpl = tmpl
+	return nil
+}
+
+// Cleanup implements StageProcessor. The template stage owns no resources
+// that outlive it.
+func (t *templateStage) Cleanup() {}
+
+func (t *templateStage) processEntry(e *Entry) {
+	t.mu.RLock()
+	cfg, tmpl := t.cfg, t.tmpl
+	t.mu.RUnlock()
+
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, e.Extracted); err != nil {
+		level.Debug(t.logger).Log("msg", "failed to execute template", "err", err)
+		return
+	}
+	e.Extracted[cfg.Source] = buf.String()
+}
@@ -0,0 +1,100 @@
+package stages
+
+import (
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+
+	util_log "github.com/grafana/loki/v3/pkg/util/log"
+)
+
+// testTemplateYamlReplacingJSONSource does in a single template stage what
+// testJSONYamlMultiStageWithSource needs a second json stage (with
+// source: extra) for.
+var testTemplateYamlReplacingJSONSource = `
+pipeline_stages:
+- json:
+    expressions:
+      extra:
+- template:
+    source: user
+    template: '{{ (unmarshalJSON .extra).user }}'
+`
+
+func TestPipeline_Template(t *testing.T) {
+	t.Parallel()
+
+	pl, err := NewPipeline(util_log.Logger, loadConfig(testTemplateYamlReplacingJSONSource), nil, prometheus.DefaultRegisterer)
+	assert.NoError(t, err, "Expected pipeline creation to not result in error")
+	out := processEntries(pl, newEntry(nil, nil, testJSONLogLine, time.Now()))[0]
+	assert.Equal(t, "marco", out.Extracted["user"])
+}
+
+func TestTemplateConfig_validate(t *testing.T) {
+	t.Parallel()
+
+	tests := map[string]struct {
+		config interface{}
+		err    error
+	}{
+		"empty config": {
+			nil,
+			errors.New(ErrEmptyTemplateStageSource),
+		},
+		"missing template": {
+			map[string]interface{}{"source": "out"},
+			errors.New(ErrEmptyTemplateStageTemplate),
+		},
+		"valid": {
+			map[string]interface{}{"source": "out", "template": "{{ .foo }}"},
+			nil,
+		},
+	}
+
+	for tName, tt := range tests {
+		t.Run(tName, func(t *testing.T) {
+			c, err := parseTemplateConfig(tt.config)
+			assert.NoError(t, err, "failed to create config: %s", err)
+			err = validateTemplateConfig(c)
+			if tt.err != nil {
+				assert.EqualError(t, err, tt.err.Error())
+				return
+			}
+			assert.NoError(t, err)
+		})
+	}
+}
+
+func TestTemplateParser_Funcs(t *testing.T) {
+	t.Parallel()
+
+	tests := map[string]struct {
+		config    TemplateConfig
+		extracted map[string]interface{}
+		expected  interface{}
+	}{
+		"unmarshalJSON pulls a field out of an embedded JSON blob": {
+			TemplateConfig{Source: "user", Template: `{{ (unmarshalJSON .extra).user }}`},
+			map[string]interface{}{"extra": `{"user":"marco"}`},
+			"marco",
+		},
+		"parseKV pulls a field out of an embedded key=value blob": {
+			TemplateConfig{Source: "team", Template: `{{ (parseKV .extra "=" ",").team }}`},
+			map[string]interface{}{"extra": "user=marco,team=loki"},
+			"loki",
+		},
+	}
+
+	for tName, tt := range tests {
+		t.Run(tName, func(t *testing.T) {
+			t.Parallel()
+			s, err := newTemplateStage(util_log.Logger, tt.config)
+			assert.NoError(t, err, "failed to create template stage: %s", err)
+			out := processEntries(s, newEntry(tt.extracted, nil, "", time.Now()))[0]
+			assert.Equal(t, tt.expected, out.Extracted[tt.config.Source])
+		})
+	}
+}